@@ -4,10 +4,12 @@ import (
 	"context"
 	"encoding/hex"
 	"io"
+	"math/rand" //#nosec // only used for refresh jitter
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/xerrors"
 
 	"cdr.dev/slog"
@@ -20,6 +22,7 @@ import (
 var (
 	ErrKeyNotFound    = xerrors.New("key not found")
 	ErrKeyInvalid     = xerrors.New("key is invalid for use")
+	ErrNoKeys         = xerrors.New("no keys exist for feature")
 	ErrClosed         = xerrors.New("closed")
 	ErrInvalidFeature = xerrors.New("invalid feature for this operation")
 )
@@ -38,6 +41,9 @@ type EncryptionKeycache interface {
 	// account for clock skew between peers (one key may be past its start time on
 	// one machine while another is not).
 	DecryptingKey(ctx context.Context, id string) (key interface{}, err error)
+	// Refresh fetches the latest keys, replacing the cached keys and resetting
+	// the refresh timer. It is useful immediately after a key has been rotated.
+	Refresh(ctx context.Context) error
 	io.Closer
 }
 
@@ -51,14 +57,18 @@ type SigningKeycache interface {
 	// to account for clock skew between peers (one key may be past its start time
 	// on one machine while another is not).
 	VerifyingKey(ctx context.Context, id string) (key interface{}, err error)
+	// Refresh fetches the latest keys, replacing the cached keys and resetting
+	// the refresh timer. It is useful immediately after a key has been rotated.
+	Refresh(ctx context.Context) error
 	io.Closer
 }
 
 const (
 	// latestSequence is a special sequence number that represents the latest key.
 	latestSequence = -1
-	// refreshInterval is the interval at which the key cache will refresh.
-	refreshInterval = time.Minute * 10
+	// defaultRefreshInterval is the default interval at which the key cache
+	// will refresh.
+	defaultRefreshInterval = time.Minute * 10
 )
 
 type DBFetcher struct {
@@ -67,6 +77,10 @@ type DBFetcher struct {
 }
 
 func (d *DBFetcher) Fetch(ctx context.Context) ([]codersdk.CryptoKey, error) {
+	if d == nil || d.DB == nil {
+		return nil, xerrors.New("db must not be nil")
+	}
+
 	keys, err := d.DB.GetCryptoKeysByFeature(ctx, d.Feature)
 	if err != nil {
 		return nil, xerrors.Errorf("get crypto keys by feature: %w", err)
@@ -77,18 +91,39 @@ func (d *DBFetcher) Fetch(ctx context.Context) ([]codersdk.CryptoKey, error) {
 
 // cache implements the caching functionality for both signing and encryption keys.
 type cache struct {
-	clock         quartz.Clock
-	refreshCtx    context.Context
-	refreshCancel context.CancelFunc
-	fetcher       Fetcher
-	logger        slog.Logger
-	feature       codersdk.CryptoKeyFeature
+	clock           quartz.Clock
+	refreshCtx      context.Context
+	refreshCancel   context.CancelFunc
+	refreshInterval time.Duration
+	refreshJitter   time.Duration
+	jitterSource    func(n int64) int64
+	fetcher         Fetcher
+	logger          slog.Logger
+	feature         codersdk.CryptoKeyFeature
+	registerer      prometheus.Registerer
+	metrics         *cacheMetrics
+	onRefreshError  func(error)
+	onLatestChanged func(old, latest codersdk.CryptoKey)
+	initialTimeout  time.Duration
+	refreshTimeout  time.Duration
+	noRefresh       bool
 
 	mu        sync.Mutex
 	keys      map[int32]codersdk.CryptoKey
 	lastFetch time.Time
+	// refresher is nil if background refreshes are disabled.
 	refresher *quartz.Timer
 	fetching  bool
+	// fetchErr is the error returned by the most recent fetch.
+	fetchErr error
+	// signingKeys is the number of keys valid for signing in the most recent
+	// fetch. It is only accessed by cryptoKeys, which never runs concurrently
+	// with itself.
+	signingKeys int
+	// notified is the latest key most recently passed to onLatestChanged, and
+	// notifying is set while a caller is delivering changes.
+	notified  codersdk.CryptoKey
+	notifying bool
 	closed    bool
 	cond      *sync.Cond
 }
@@ -101,6 +136,97 @@ func WithCacheClock(clock quartz.Clock) CacheOption {
 	}
 }
 
+// WithCacheRefreshInterval overrides the interval at which the cache refreshes
+// its keys. Non-positive durations are ignored.
+func WithCacheRefreshInterval(interval time.Duration) CacheOption {
+	return func(d *cache) {
+		if interval > 0 {
+			d.refreshInterval = interval
+		}
+	}
+}
+
+// WithCacheRefreshJitter adds a random delay of up to jitter to each refresh
+// interval, including the first, so that caches started at the same time don't
+// all fetch at once. Non-positive durations are ignored.
+func WithCacheRefreshJitter(jitter time.Duration) CacheOption {
+	return func(d *cache) {
+		if jitter > 0 {
+			d.refreshJitter = jitter
+		}
+	}
+}
+
+// WithCacheJitterSource sets the source of the random delay added by
+// WithCacheRefreshJitter. It is mainly useful for making tests deterministic.
+// The source is only used with the cache's lock held.
+func WithCacheJitterSource(src rand.Source) CacheOption {
+	return func(d *cache) {
+		d.jitterSource = rand.New(src).Int63n
+	}
+}
+
+// WithCacheMetrics registers counters for cache hits, misses and refreshes with
+// the provided registerer.
+func WithCacheMetrics(reg prometheus.Registerer) CacheOption {
+	return func(d *cache) {
+		d.registerer = reg
+	}
+}
+
+// WithCacheRefreshErrorHandler sets a function that is called with the error
+// from each failed background refresh, in addition to it being logged. The
+// handler is called without any locks held, so it may use the cache.
+func WithCacheRefreshErrorHandler(fn func(error)) CacheOption {
+	return func(d *cache) {
+		d.onRefreshError = fn
+	}
+}
+
+// WithCacheLatestChangedCallback sets a function that is called when a fetch
+// changes the latest key, such as after a rotation. old is the zero value if
+// there was no valid latest key. The callback is called without any locks
+// held, so it may use the cache. Calls are never concurrent and are made in
+// fetch order, with old always being the previous call's latest. Changes from
+// fetches that complete while a call is in progress are coalesced into the
+// next call.
+func WithCacheLatestChangedCallback(fn func(old, latest codersdk.CryptoKey)) CacheOption {
+	return func(d *cache) {
+		d.onLatestChanged = fn
+	}
+}
+
+// WithCacheInitialFetchTimeout bounds the initial fetch made when constructing
+// the cache, independent of the context passed to the constructor. Background
+// refreshes are unaffected. Non-positive durations are ignored.
+func WithCacheInitialFetchTimeout(timeout time.Duration) CacheOption {
+	return func(d *cache) {
+		if timeout > 0 {
+			d.initialTimeout = timeout
+		}
+	}
+}
+
+// WithCacheRefreshTimeout bounds each background refresh so that a fetch that
+// hangs is abandoned rather than delaying every later refresh. Non-positive
+// durations are ignored.
+func WithCacheRefreshTimeout(timeout time.Duration) CacheOption {
+	return func(d *cache) {
+		if timeout > 0 {
+			d.refreshTimeout = timeout
+		}
+	}
+}
+
+// WithoutCacheBackgroundRefresh disables the background refresh timer. Keys are
+// then only fetched on a cache miss or by calling Refresh, which suits
+// short-lived uses that only need to look up a key or two.
+func WithoutCacheBackgroundRefresh() CacheOption {
+	return func(d *cache) {
+		d.noRefresh = true
+	}
+}
+
 // NewSigningCache instantiates a cache. Close should be called to release resources
 // associated with its internal timer.
 func NewSigningCache(ctx context.Context, logger slog.Logger, fetcher Fetcher,
@@ -122,27 +248,55 @@ func NewEncryptionCache(ctx context.Context, logger slog.Logger, fetcher Fetcher
 }
 
 func newCache(ctx context.Context, logger slog.Logger, fetcher Fetcher, feature codersdk.CryptoKeyFeature, opts ...func(*cache)) (*cache, error) {
+	if fetcher == nil {
+		return nil, xerrors.New("fetcher must not be nil")
+	}
+
 	cache := &cache{
-		clock:   quartz.NewReal(),
-		logger:  logger,
-		fetcher: fetcher,
-		feature: feature,
+		clock:           quartz.NewReal(),
+		refreshInterval: defaultRefreshInterval,
+		jitterSource:    rand.Int63n,
+		logger:          logger,
+		fetcher:         fetcher,
+		feature:         feature,
 	}
 
 	for _, opt := range opts {
 		opt(cache)
 	}
 
+	if cache.registerer != nil {
+		metrics, err := newCacheMetrics(cache.registerer)
+		if err != nil {
+			return nil, xerrors.Errorf("metrics: %w", err)
+		}
+		cache.metrics = metrics
+	}
+
 	cache.cond = sync.NewCond(&cache.mu)
 	cache.refreshCtx, cache.refreshCancel = context.WithCancel(ctx)
-	cache.refresher = cache.clock.AfterFunc(refreshInterval, cache.refresh)
+	if !cache.noRefresh {
+		cache.refresher = cache.clock.AfterFunc(cache.nextRefresh(), cache.refresh)
+	}
 
-	keys, err := cache.cryptoKeys(ctx)
+	fetchCtx := ctx
+	if cache.initialTimeout > 0 {
+		var cancel context.CancelFunc
+		fetchCtx, cancel = context.WithTimeout(ctx, cache.initialTimeout)
+		defer cancel()
+	}
+
+	keys, err := cache.cryptoKeys(fetchCtx)
 	if err != nil {
 		cache.refreshCancel()
+		cache.stopRefresher()
+		if ctx.Err() == nil && xerrors.Is(fetchCtx.Err(), context.DeadlineExceeded) {
+			return nil, xerrors.Errorf("initial fetch timed out after %s: %w", cache.initialTimeout, err)
+		}
 		return nil, xerrors.Errorf("initial fetch: %w", err)
 	}
 	cache.keys = keys
+	cache.notified = keys[latestSequence]
 	return cache, nil
 }
 
@@ -220,6 +374,10 @@ func idSecret(k codersdk.CryptoKey) (string, []byte, error) {
 }
 
 func (c *cache) cryptoKey(ctx context.Context, sequence int32) (string, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -227,43 +385,85 @@ func (c *cache) cryptoKey(ctx context.Context, sequence int32) (string, []byte,
 		return "", nil, ErrClosed
 	}
 
-	var key codersdk.CryptoKey
-	var ok bool
-	for key, ok = c.key(sequence); !ok && c.fetching && !c.closed; {
-		c.cond.Wait()
+	key, ok := c.key(sequence)
+	if ok {
+		c.metrics.hit(c.feature)
+		return checkKey(key, sequence, c.clock.Now())
 	}
+	c.metrics.miss(c.feature)
 
-	if c.closed {
-		return "", nil, ErrClosed
+	// Wait for a fetch that is already in flight rather than piling onto the
+	// fetcher.
+	if c.fetching {
+		stop := context.AfterFunc(ctx, c.wake)
+		defer stop()
 	}
+	for c.fetching {
+		c.cond.Wait()
+		if c.closed {
+			return "", nil, ErrClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return "", nil, err
+		}
+		if c.fetching {
+			continue
+		}
 
-	if ok {
-		return checkKey(key, sequence, c.clock.Now())
+		key, ok = c.key(sequence)
+		if ok {
+			return checkKey(key, sequence, c.clock.Now())
+		}
+		// The fetch we waited on is as fresh as one we would make ourselves,
+		// so use its result. The exception is a fetch that was abandoned
+		// because the context of the caller that started it was canceled,
+		// which says nothing about the keys, so we fetch them ourselves.
+		if !isContextError(c.fetchErr) {
+			if c.fetchErr != nil {
+				return "", nil, c.fetchErr
+			}
+			return "", nil, c.missingKeyError(sequence)
+		}
 	}
 
-	c.fetching = true
-	c.mu.Unlock()
-
-	keys, err := c.cryptoKeys(ctx)
+	err := c.fetch(ctx)
 	if err != nil {
-		return "", nil, xerrors.Errorf("get keys: %w", err)
+		return "", nil, err
 	}
 
-	c.mu.Lock()
-	c.lastFetch = c.clock.Now()
-	c.refresher.Reset(refreshInterval)
-	c.keys = keys
-	c.fetching = false
-	c.cond.Broadcast()
-
 	key, ok = c.key(sequence)
 	if !ok {
-		return "", nil, ErrKeyNotFound
+		return "", nil, c.missingKeyError(sequence)
 	}
 
 	return checkKey(key, sequence, c.clock.Now())
 }
 
+// wake wakes any callers waiting on a fetch so they can check whether their
+// context is done.
+func (c *cache) wake() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+func isContextError(err error) bool {
+	return xerrors.Is(err, context.Canceled) || xerrors.Is(err, context.DeadlineExceeded)
+}
+
+// missingKeyError returns the error for a key that is not in the cache. When
+// requesting the latest key we distinguish between no keys existing at all and
+// keys existing but none of them being valid for use yet.
+func (c *cache) missingKeyError(sequence int32) error {
+	if sequence != latestSequence {
+		return ErrKeyNotFound
+	}
+	if len(c.keys) == 0 {
+		return ErrNoKeys
+	}
+	return ErrKeyInvalid
+}
+
 func (c *cache) key(sequence int32) (codersdk.CryptoKey, bool) {
 	if sequence == latestSequence {
 		return c.keys[latestSequence], c.keys[latestSequence].CanSign(c.clock.Now())
@@ -288,45 +488,157 @@ func checkKey(key codersdk.CryptoKey, sequence int32, now time.Time) (string, []
 	return idSecret(key)
 }
 
-// refresh fetches the keys and updates the cache.
+// refresh is called by the refresh timer.
 func (c *cache) refresh() {
+	err := c.refreshKeys()
+	if err != nil && c.onRefreshError != nil {
+		c.onRefreshError(err)
+	}
+}
+
+// refreshKeys fetches the keys and updates the cache, returning the error from
+// the fetch if there was one.
+func (c *cache) refreshKeys() error {
 	now := c.clock.Now("CryptoKeyCache", "refresh")
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if c.closed {
-		return
+		return nil
 	}
 
 	// If something's already fetching, we don't need to do anything.
 	if c.fetching {
-		return
+		return nil
 	}
 
 	// There's a window we must account for where the timer fires while a fetch
 	// is ongoing but prior to the timer getting reset. In this case we want to
 	// avoid double fetching.
-	if now.Sub(c.lastFetch) < refreshInterval {
-		return
+	if now.Sub(c.lastFetch) < c.refreshInterval {
+		return nil
 	}
 
-	c.fetching = true
+	ctx := c.refreshCtx
+	if c.refreshTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(c.refreshCtx, c.refreshTimeout)
+		defer cancel()
+	}
 
-	c.mu.Unlock()
-	keys, err := c.cryptoKeys(c.refreshCtx)
+	err := c.fetch(ctx)
+	c.metrics.refresh(c.feature, err)
 	if err != nil {
-		c.logger.Error(c.refreshCtx, "fetch crypto keys", slog.Error(err))
-		return
+		// Try again on the next interval.
+		if c.refreshCtx.Err() == nil && xerrors.Is(ctx.Err(), context.DeadlineExceeded) {
+			c.logger.Error(c.refreshCtx, "fetch crypto keys timed out", slog.F("timeout", c.refreshTimeout), slog.Error(err))
+		} else {
+			c.logger.Error(c.refreshCtx, "fetch crypto keys", slog.Error(err))
+		}
+		c.resetRefresher()
+		return err
+	}
+	return nil
+}
+
+func (c *cache) resetRefresher() {
+	if c.refresher != nil {
+		c.refresher.Reset(c.nextRefresh())
+	}
+}
+
+func (c *cache) stopRefresher() {
+	if c.refresher != nil {
+		c.refresher.Stop()
+	}
+}
+
+// nextRefresh returns the duration until the next refresh.
+func (c *cache) nextRefresh() time.Duration {
+	if c.refreshJitter <= 0 {
+		return c.refreshInterval
+	}
+	return c.refreshInterval + time.Duration(c.jitterSource(int64(c.refreshJitter)))
+}
+
+// Refresh fetches the latest keys regardless of when they were last fetched.
+func (c *cache) Refresh(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	// We don't defer an unlock here due to the deferred unlock at the top of the function.
 	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	c.lastFetch = c.clock.Now()
-	c.refresher.Reset(refreshInterval)
-	c.keys = keys
+	// A fetch that is already in flight may have started prior to a rotation,
+	// so we wait for it to finish and fetch again.
+	if c.fetching {
+		stop := context.AfterFunc(ctx, c.wake)
+		defer stop()
+	}
+	for c.fetching && !c.closed && ctx.Err() == nil {
+		c.cond.Wait()
+	}
+
+	if c.closed {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := c.fetch(ctx)
+	c.metrics.refresh(c.feature, err)
+	return err
+}
+
+// fetch fetches the keys and replaces the cached keys. It must be called with
+// the lock held and no other fetch in progress. The lock is released while
+// fetching and while calling onLatestChanged. On error the previously fetched
+// keys are kept.
+func (c *cache) fetch(ctx context.Context) error {
+	c.fetching = true
+	c.mu.Unlock()
+
+	keys, err := c.cryptoKeys(ctx)
+
+	c.mu.Lock()
 	c.fetching = false
 	c.cond.Broadcast()
+	if err != nil {
+		c.fetchErr = xerrors.Errorf("get keys: %w", err)
+		return c.fetchErr
+	}
+	c.fetchErr = nil
+
+	c.lastFetch = c.clock.Now()
+	c.resetRefresher()
+	c.keys = keys
+
+	if c.onLatestChanged != nil {
+		c.notifyLatestChanged()
+	}
+	return nil
+}
+
+// notifyLatestChanged calls onLatestChanged until it has been told about the
+// current latest key. It must be called with the lock held, and releases the
+// lock while calling onLatestChanged. Only one caller delivers changes at a
+// time, so a fetch that completes during a call leaves its change to the
+// caller that is already delivering.
+func (c *cache) notifyLatestChanged() {
+	if c.notifying {
+		return
+	}
+	c.notifying = true
+	for c.keys[latestSequence].Sequence != c.notified.Sequence {
+		old, latest := c.notified, c.keys[latestSequence]
+		c.notified = latest
+		c.mu.Unlock()
+		c.onLatestChanged(old, latest)
+		c.mu.Lock()
+	}
+	c.notifying = false
 }
 
 // cryptoKeys queries the control plane for the crypto keys.
@@ -336,20 +648,46 @@ func (c *cache) cryptoKeys(ctx context.Context) (map[int32]codersdk.CryptoKey, e
 	if err != nil {
 		return nil, xerrors.Errorf("crypto keys: %w", err)
 	}
-	cache := toKeyMap(keys, c.clock.Now())
+	cache, signable := toKeyMap(keys, c.clock.Now())
+	c.metrics.setSigningKeys(c.feature, signable)
+	// Only log when the count changes to avoid logging on every fetch while
+	// the condition persists.
+	if signable > 1 && signable != c.signingKeys {
+		c.logger.Warn(ctx, "multiple crypto keys are valid for signing, using the highest sequence",
+			slog.F("feature", c.feature),
+			slog.F("count", signable),
+			slog.F("sequence", cache[latestSequence].Sequence),
+		)
+	}
+	c.signingKeys = signable
 	return cache, nil
 }
 
-func toKeyMap(keys []codersdk.CryptoKey, now time.Time) map[int32]codersdk.CryptoKey {
+// toKeyMap indexes the keys by sequence and stores the highest sequence key
+// that is valid for signing as the latest. It also returns the number of keys
+// that are valid for signing and not scheduled for deletion. During a rotation
+// the old key remains valid until it is deleted, so more than one such key
+// indicates a misconfiguration.
+func toKeyMap(keys []codersdk.CryptoKey, now time.Time) (map[int32]codersdk.CryptoKey, int) {
 	m := make(map[int32]codersdk.CryptoKey)
-	var latest codersdk.CryptoKey
+	var (
+		latest   codersdk.CryptoKey
+		signable int
+	)
 	for _, key := range keys {
 		m[key.Sequence] = key
-		if key.Sequence > latest.Sequence && key.CanSign(now) {
+		if !key.CanSign(now) {
+			continue
+		}
+		if key.DeletesAt.IsZero() {
+			signable++
+		}
+		if key.Sequence > latest.Sequence {
+			latest = key
 			m[latestSequence] = key
 		}
 	}
-	return m
+	return m, signable
 }
 
 func (c *cache) Close() error {
@@ -362,7 +700,7 @@ func (c *cache) Close() error {
 
 	c.closed = true
 	c.refreshCancel()
-	c.refresher.Stop()
+	c.stopRefresher()
 	c.cond.Broadcast()
 
 	return nil
@@ -2,18 +2,25 @@ package cryptokeys_test
 
 import (
 	"context"
-	"crypto/rand"
+	cryptorand "crypto/rand"
 	"encoding/hex"
+	"math/rand"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
+	"golang.org/x/xerrors"
 
+	"cdr.dev/slog"
 	"cdr.dev/slog/sloggers/slogtest"
 
 	"github.com/coder/coder/v2/coderd/cryptokeys"
+	"github.com/coder/coder/v2/coderd/database"
 	"github.com/coder/coder/v2/codersdk"
 	"github.com/coder/coder/v2/testutil"
 	"github.com/coder/quartz"
@@ -138,7 +145,110 @@ func TestCryptoKeyCache(t *testing.T) {
 			require.Equal(t, 1, ff.called)
 		})
 
-		t.Run("KeyNotFound", func(t *testing.T) {
+		t.Run("PicksHighestSequence", func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				ctx    = testutil.Context(t, testutil.WaitShort)
+				logger = slogtest.Make(t, nil)
+				clock  = quartz.NewMock(t)
+			)
+			now := clock.Now().UTC()
+
+			expected := codersdk.CryptoKey{
+				Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+				Secret:   generateKey(t, 64),
+				Sequence: 13,
+				StartsAt: now,
+			}
+
+			// Both keys are valid for signing, the order returned by the
+			// fetcher should not determine which one is used.
+			ff := &fakeFetcher{
+				keys: []codersdk.CryptoKey{
+					expected,
+					{
+						Feature:   codersdk.CryptoKeyFeatureTailnetResume,
+						Secret:    generateKey(t, 64),
+						Sequence:  12,
+						StartsAt:  now.Add(-time.Hour),
+						DeletesAt: now.Add(time.Hour),
+					},
+				},
+			}
+
+			cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume, cryptokeys.WithCacheClock(clock))
+			require.NoError(t, err)
+
+			id, got, err := cache.SigningKey(ctx)
+			require.NoError(t, err)
+			require.Equal(t, keyID(expected), id)
+			require.Equal(t, decodedSecret(t, expected), got)
+			require.Equal(t, 1, ff.called)
+		})
+
+		t.Run("WarnsOnOverlappingKeys", func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				ctx    = testutil.Context(t, testutil.WaitShort)
+				sink   = &fakeSink{}
+				logger = slog.Make(sink)
+				clock  = quartz.NewMock(t)
+				reg    = prometheus.NewRegistry()
+			)
+			now := clock.Now().UTC()
+
+			expected := codersdk.CryptoKey{
+				Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+				Secret:   generateKey(t, 64),
+				Sequence: 13,
+				StartsAt: now,
+			}
+
+			// Neither key is scheduled for deletion, so this is not a
+			// rotation in progress.
+			ff := &fakeFetcher{
+				keys: []codersdk.CryptoKey{
+					expected,
+					{
+						Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+						Secret:   generateKey(t, 64),
+						Sequence: 12,
+						StartsAt: now.Add(-time.Hour),
+					},
+				},
+			}
+
+			cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume,
+				cryptokeys.WithCacheClock(clock),
+				cryptokeys.WithCacheMetrics(reg),
+			)
+			require.NoError(t, err)
+			require.Len(t, sink.entries, 1)
+			require.Equal(t, slog.LevelWarn, sink.entries[0].Level)
+			require.Contains(t, sink.entries[0].Message, "multiple crypto keys are valid for signing")
+			requireSigningKeys(t, reg, codersdk.CryptoKeyFeatureTailnetResume, 2)
+
+			id, got, err := cache.SigningKey(ctx)
+			require.NoError(t, err)
+			require.Equal(t, keyID(expected), id)
+			require.Equal(t, decodedSecret(t, expected), got)
+
+			// The warning is only logged when the count changes.
+			err = cache.Refresh(ctx)
+			require.NoError(t, err)
+			require.Len(t, sink.entries, 1)
+
+			// A key that is being rotated out should not be reported.
+			ff.keys[1].DeletesAt = now.Add(time.Hour)
+			err = cache.Refresh(ctx)
+			require.NoError(t, err)
+			require.Len(t, sink.entries, 1)
+			requireSigningKeys(t, reg, codersdk.CryptoKeyFeatureTailnetResume, 1)
+		})
+
+		t.Run("NoKeys", func(t *testing.T) {
 			t.Parallel()
 
 			var (
@@ -154,7 +264,36 @@ func TestCryptoKeyCache(t *testing.T) {
 			require.NoError(t, err)
 
 			_, _, err = cache.SigningKey(ctx)
-			require.ErrorIs(t, err, cryptokeys.ErrKeyNotFound)
+			require.ErrorIs(t, err, cryptokeys.ErrNoKeys)
+		})
+
+		t.Run("NoValidKey", func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				ctx    = testutil.Context(t, testutil.WaitShort)
+				logger = slogtest.Make(t, nil)
+				clock  = quartz.NewMock(t)
+			)
+
+			// The only key hasn't started yet.
+			ff := &fakeFetcher{
+				keys: []codersdk.CryptoKey{
+					{
+						Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+						Secret:   generateKey(t, 64),
+						Sequence: 12,
+						StartsAt: clock.Now().UTC().Add(time.Minute),
+					},
+				},
+			}
+
+			cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume, cryptokeys.WithCacheClock(clock))
+			require.NoError(t, err)
+
+			_, _, err = cache.SigningKey(ctx)
+			require.ErrorIs(t, err, cryptokeys.ErrKeyInvalid)
+			require.NotErrorIs(t, err, cryptokeys.ErrNoKeys)
 		})
 	})
 
@@ -318,6 +457,114 @@ func TestCryptoKeyCache(t *testing.T) {
 		})
 	})
 
+	t.Run("ConcurrentMisses", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx    = testutil.Context(t, testutil.WaitShort)
+			logger = slogtest.Make(t, nil)
+			clock  = quartz.NewMock(t)
+		)
+
+		ff := &fakeFetcher{
+			keys: []codersdk.CryptoKey{},
+		}
+
+		reg := prometheus.NewRegistry()
+		cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume,
+			cryptokeys.WithCacheClock(clock),
+			cryptokeys.WithCacheMetrics(reg),
+		)
+		require.NoError(t, err)
+
+		expected := codersdk.CryptoKey{
+			Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+			Secret:   generateKey(t, 64),
+			Sequence: 12,
+			StartsAt: clock.Now().UTC(),
+		}
+		ff.keys = []codersdk.CryptoKey{expected}
+		ff.block = make(chan struct{})
+
+		const n = 10
+		var wg sync.WaitGroup
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				got, err := cache.VerifyingKey(ctx, keyID(expected))
+				assert.NoError(t, err)
+				assert.Equal(t, decodedSecret(t, expected), got)
+			}()
+		}
+		waitForMisses(ctx, t, reg, codersdk.CryptoKeyFeatureTailnetResume, n)
+		close(ff.block)
+		wg.Wait()
+
+		// 1 on startup + a single fetch shared by every miss.
+		require.Equal(t, 2, ff.called)
+	})
+
+	t.Run("CanceledSharedFetch", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx    = testutil.Context(t, testutil.WaitShort)
+			logger = slogtest.Make(t, nil)
+			clock  = quartz.NewMock(t)
+			reg    = prometheus.NewRegistry()
+		)
+
+		ff := &fakeFetcher{
+			keys: []codersdk.CryptoKey{},
+		}
+
+		cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume,
+			cryptokeys.WithCacheClock(clock),
+			cryptokeys.WithCacheMetrics(reg),
+		)
+		require.NoError(t, err)
+
+		expected := codersdk.CryptoKey{
+			Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+			Secret:   generateKey(t, 64),
+			Sequence: 12,
+			StartsAt: clock.Now().UTC(),
+		}
+		ff.keys = []codersdk.CryptoKey{expected}
+		ff.block = make(chan struct{})
+
+		// The first lookup starts a fetch and the second waits on it.
+		firstCtx, cancel := context.WithCancel(ctx)
+		firstErr := make(chan error, 1)
+		go func() {
+			_, err := cache.VerifyingKey(firstCtx, keyID(expected))
+			firstErr <- err
+		}()
+		waitForMisses(ctx, t, reg, codersdk.CryptoKeyFeatureTailnetResume, 1)
+
+		secondErr := make(chan error, 1)
+		go func() {
+			got, err := cache.VerifyingKey(ctx, keyID(expected))
+			assert.Equal(t, decodedSecret(t, expected), got)
+			secondErr <- err
+		}()
+		waitForMisses(ctx, t, reg, codersdk.CryptoKeyFeatureTailnetResume, 2)
+
+		// Canceling the first caller abandons its fetch. The second caller's
+		// context is fine, so it should fetch for itself rather than return
+		// the first caller's context error.
+		cancel()
+		err = testutil.RequireRecvCtx(ctx, t, firstErr)
+		require.ErrorIs(t, err, context.Canceled)
+		close(ff.block)
+		err = testutil.RequireRecvCtx(ctx, t, secondErr)
+		require.NoError(t, err)
+
+		// 1 on startup + 1 abandoned + 1 retried.
+		require.Equal(t, 3, ff.called)
+	})
+
 	t.Run("CacheRefreshes", func(t *testing.T) {
 		t.Parallel()
 
@@ -378,10 +625,47 @@ func TestCryptoKeyCache(t *testing.T) {
 		require.Equal(t, time.Minute*10, dur)
 	})
 
-	// This test ensures that if the refresh timer races with an inflight request
-	// and loses that it doesn't cause a redundant fetch.
+	t.Run("CustomRefreshInterval", func(t *testing.T) {
+		t.Parallel()
 
-	t.Run("RefreshNoDoubleFetch", func(t *testing.T) {
+		var (
+			ctx    = testutil.Context(t, testutil.WaitShort)
+			logger = slogtest.Make(t, nil)
+			clock  = quartz.NewMock(t)
+		)
+
+		now := clock.Now().UTC()
+		ff := &fakeFetcher{
+			keys: []codersdk.CryptoKey{
+				{
+					Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+					Secret:   generateKey(t, 64),
+					Sequence: 12,
+					StartsAt: now,
+				},
+			},
+		}
+
+		_, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume,
+			cryptokeys.WithCacheClock(clock),
+			cryptokeys.WithCacheRefreshInterval(time.Minute),
+		)
+		require.NoError(t, err)
+		require.Equal(t, 1, ff.called)
+
+		dur, advance := clock.AdvanceNext()
+		advance.MustWait(ctx)
+		require.Equal(t, time.Minute, dur)
+		require.Equal(t, 2, ff.called)
+
+		// The timer should be reset to the configured interval.
+		dur, advance = clock.AdvanceNext()
+		advance.MustWait(ctx)
+		require.Equal(t, time.Minute, dur)
+		require.Equal(t, 3, ff.called)
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
 		t.Parallel()
 
 		var (
@@ -391,53 +675,55 @@ func TestCryptoKeyCache(t *testing.T) {
 		)
 
 		now := clock.Now().UTC()
-		expected := codersdk.CryptoKey{
-			Feature:   codersdk.CryptoKeyFeatureTailnetResume,
-			Secret:    generateKey(t, 64),
-			Sequence:  12,
-			StartsAt:  now,
-			DeletesAt: now.Add(time.Minute * 10),
+		oldKey := codersdk.CryptoKey{
+			Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+			Secret:   generateKey(t, 64),
+			Sequence: 12,
+			StartsAt: now,
 		}
 		ff := &fakeFetcher{
 			keys: []codersdk.CryptoKey{
-				expected,
+				oldKey,
 			},
 		}
 
-		// Create a trap that blocks when the refresh timer fires.
-		trap := clock.Trap().Now("refresh")
 		cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume, cryptokeys.WithCacheClock(clock))
 		require.NoError(t, err)
 
-		_, wait := clock.AdvanceNext()
-		trapped := trap.MustWait(ctx)
-
+		// Rotate the key, the old key remains valid for signing.
+		oldKey.DeletesAt = now.Add(time.Hour)
 		newKey := codersdk.CryptoKey{
 			Feature:  codersdk.CryptoKeyFeatureTailnetResume,
 			Secret:   generateKey(t, 64),
 			Sequence: 13,
 			StartsAt: now,
 		}
-		ff.keys = []codersdk.CryptoKey{newKey}
+		ff.keys = []codersdk.CryptoKey{oldKey, newKey}
 
-		key, err := cache.VerifyingKey(ctx, keyID(newKey))
+		// The cached key is still valid so we shouldn't see the new one yet.
+		id, _, err := cache.SigningKey(ctx)
+		require.NoError(t, err)
+		require.Equal(t, keyID(oldKey), id)
+		require.Equal(t, 1, ff.called)
+
+		err = cache.Refresh(ctx)
 		require.NoError(t, err)
 		require.Equal(t, 2, ff.called)
-		require.Equal(t, decodedSecret(t, newKey), key)
 
-		trapped.Release()
-		wait.MustWait(ctx)
+		id, got, err := cache.SigningKey(ctx)
+		require.NoError(t, err)
+		require.Equal(t, keyID(newKey), id)
+		require.Equal(t, decodedSecret(t, newKey), got)
 		require.Equal(t, 2, ff.called)
-		trap.Close()
 
-		// The next timer should fire in 10 minutes.
-		dur, wait := clock.AdvanceNext()
-		wait.MustWait(ctx)
+		// The refresh timer should have been reset.
+		dur, advance := clock.AdvanceNext()
+		advance.MustWait(ctx)
 		require.Equal(t, time.Minute*10, dur)
 		require.Equal(t, 3, ff.called)
 	})
 
-	t.Run("Closed", func(t *testing.T) {
+	t.Run("RefreshJitter", func(t *testing.T) {
 		t.Parallel()
 
 		var (
@@ -446,7 +732,51 @@ func TestCryptoKeyCache(t *testing.T) {
 			clock  = quartz.NewMock(t)
 		)
 
-		now := clock.Now()
+		ff := &fakeFetcher{
+			keys: []codersdk.CryptoKey{
+				{
+					Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+					Secret:   generateKey(t, 64),
+					Sequence: 12,
+					StartsAt: clock.Now().UTC(),
+				},
+			},
+		}
+
+		const (
+			seed   = 42
+			jitter = time.Second * 30
+		)
+		_, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume,
+			cryptokeys.WithCacheClock(clock),
+			cryptokeys.WithCacheRefreshInterval(time.Minute),
+			cryptokeys.WithCacheRefreshJitter(jitter),
+			cryptokeys.WithCacheJitterSource(rand.NewSource(seed)),
+		)
+		require.NoError(t, err)
+
+		// Both the first refresh and the ones after it should be jittered.
+		expected := rand.New(rand.NewSource(seed))
+		for i := 0; i < 3; i++ {
+			dur, advance := clock.AdvanceNext()
+			advance.MustWait(ctx)
+			require.Equal(t, time.Minute+time.Duration(expected.Int63n(int64(jitter))), dur)
+			require.Equal(t, i+2, ff.called)
+		}
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx    = testutil.Context(t, testutil.WaitShort)
+			logger = slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			clock  = quartz.NewMock(t)
+			reg    = prometheus.NewRegistry()
+			label  = string(codersdk.CryptoKeyFeatureTailnetResume)
+		)
+
+		now := clock.Now().UTC()
 		expected := codersdk.CryptoKey{
 			Feature:  codersdk.CryptoKeyFeatureTailnetResume,
 			Secret:   generateKey(t, 64),
@@ -459,40 +789,706 @@ func TestCryptoKeyCache(t *testing.T) {
 			},
 		}
 
-		cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume, cryptokeys.WithCacheClock(clock))
+		cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume,
+			cryptokeys.WithCacheClock(clock),
+			cryptokeys.WithCacheMetrics(reg),
+		)
 		require.NoError(t, err)
 
-		id, got, err := cache.SigningKey(ctx)
+		// A second cache can share the registry.
+		_, err = cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureOIDCConvert,
+			cryptokeys.WithCacheClock(clock),
+			cryptokeys.WithCacheMetrics(reg),
+		)
 		require.NoError(t, err)
-		require.Equal(t, keyID(expected), id)
-		require.Equal(t, decodedSecret(t, expected), got)
-		require.Equal(t, 1, ff.called)
 
-		key, err := cache.VerifyingKey(ctx, keyID(expected))
+		_, _, err = cache.SigningKey(ctx)
 		require.NoError(t, err)
-		require.Equal(t, decodedSecret(t, expected), key)
-		require.Equal(t, 1, ff.called)
+		_, err = cache.VerifyingKey(ctx, "13")
+		require.ErrorIs(t, err, cryptokeys.ErrKeyNotFound)
 
-		cache.Close()
+		metrics, err := reg.Gather()
+		require.NoError(t, err)
+		require.True(t, testutil.PromCounterHasValue(t, metrics, 1, "coderd_keychain_cache_hits_total", label))
+		require.True(t, testutil.PromCounterHasValue(t, metrics, 1, "coderd_keychain_cache_misses_total", label))
 
-		_, _, err = cache.SigningKey(ctx)
-		require.ErrorIs(t, err, cryptokeys.ErrClosed)
+		err = cache.Refresh(ctx)
+		require.NoError(t, err)
 
-		_, err = cache.VerifyingKey(ctx, keyID(expected))
-		require.ErrorIs(t, err, cryptokeys.ErrClosed)
+		ff.err = xerrors.New("fetch failed")
+		err = cache.Refresh(ctx)
+		require.Error(t, err)
+
+		metrics, err = reg.Gather()
+		require.NoError(t, err)
+		require.True(t, testutil.PromCounterHasValue(t, metrics, 2, "coderd_keychain_refresh_total", label))
+		require.True(t, testutil.PromCounterHasValue(t, metrics, 1, "coderd_keychain_refresh_errors_total", label))
 	})
-}
 
-type fakeFetcher struct {
-	keys   []codersdk.CryptoKey
+	// This test ensures that if the refresh timer races with an inflight request
+	// and loses that it doesn't cause a redundant fetch.
+
+	t.Run("RefreshNoDoubleFetch", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx    = testutil.Context(t, testutil.WaitShort)
+			logger = slogtest.Make(t, nil)
+			clock  = quartz.NewMock(t)
+		)
+
+		now := clock.Now().UTC()
+		expected := codersdk.CryptoKey{
+			Feature:   codersdk.CryptoKeyFeatureTailnetResume,
+			Secret:    generateKey(t, 64),
+			Sequence:  12,
+			StartsAt:  now,
+			DeletesAt: now.Add(time.Minute * 10),
+		}
+		ff := &fakeFetcher{
+			keys: []codersdk.CryptoKey{
+				expected,
+			},
+		}
+
+		// Create a trap that blocks when the refresh timer fires.
+		trap := clock.Trap().Now("refresh")
+		cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume, cryptokeys.WithCacheClock(clock))
+		require.NoError(t, err)
+
+		_, wait := clock.AdvanceNext()
+		trapped := trap.MustWait(ctx)
+
+		newKey := codersdk.CryptoKey{
+			Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+			Secret:   generateKey(t, 64),
+			Sequence: 13,
+			StartsAt: now,
+		}
+		ff.keys = []codersdk.CryptoKey{newKey}
+
+		key, err := cache.VerifyingKey(ctx, keyID(newKey))
+		require.NoError(t, err)
+		require.Equal(t, 2, ff.called)
+		require.Equal(t, decodedSecret(t, newKey), key)
+
+		trapped.Release()
+		wait.MustWait(ctx)
+		require.Equal(t, 2, ff.called)
+		trap.Close()
+
+		// The next timer should fire in 10 minutes.
+		dur, wait := clock.AdvanceNext()
+		wait.MustWait(ctx)
+		require.Equal(t, time.Minute*10, dur)
+		require.Equal(t, 3, ff.called)
+	})
+
+	t.Run("FetchErrorKeepsKeys", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx    = testutil.Context(t, testutil.WaitShort)
+			logger = slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			clock  = quartz.NewMock(t)
+			reg    = prometheus.NewRegistry()
+		)
+
+		now := clock.Now().UTC()
+		expected := codersdk.CryptoKey{
+			Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+			Secret:   generateKey(t, 64),
+			Sequence: 12,
+			StartsAt: now,
+		}
+		ff := &fakeFetcher{
+			keys: []codersdk.CryptoKey{
+				expected,
+			},
+		}
+
+		cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume,
+			cryptokeys.WithCacheClock(clock),
+			cryptokeys.WithCacheMetrics(reg),
+		)
+		require.NoError(t, err)
+		require.Equal(t, 1, ff.called)
+
+		ff.err = xerrors.New("fetch failed")
+
+		// A failed refresh should not clobber the cached keys.
+		_, advance := clock.AdvanceNext()
+		advance.MustWait(ctx)
+		require.Equal(t, 2, ff.called)
+
+		id, got, err := cache.SigningKey(ctx)
+		require.NoError(t, err)
+		require.Equal(t, keyID(expected), id)
+		require.Equal(t, decodedSecret(t, expected), got)
+		require.Equal(t, 2, ff.called)
+
+		// A failed fetch on a cache miss should surface the error without
+		// wedging subsequent lookups.
+		_, err = cache.VerifyingKey(ctx, "13")
+		require.ErrorIs(t, err, ff.err)
+		require.Equal(t, 3, ff.called)
+
+		key, err := cache.VerifyingKey(ctx, keyID(expected))
+		require.NoError(t, err)
+		require.Equal(t, decodedSecret(t, expected), key)
+		require.Equal(t, 3, ff.called)
+
+		// Concurrent misses waiting on a failed fetch should all see its
+		// error rather than each retrying.
+		ff.block = make(chan struct{})
+		const n = 10
+		var wg sync.WaitGroup
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := cache.VerifyingKey(ctx, "13")
+				assert.ErrorIs(t, err, ff.err)
+			}()
+		}
+		// One miss from the lookup above, plus one per goroutine.
+		waitForMisses(ctx, t, reg, codersdk.CryptoKeyFeatureTailnetResume, n+1)
+		close(ff.block)
+		wg.Wait()
+		require.Equal(t, 4, ff.called)
+		ff.block = nil
+
+		// The timer should have been reset so the refresh is retried.
+		ff.err = nil
+		dur, advance := clock.AdvanceNext()
+		advance.MustWait(ctx)
+		require.Equal(t, time.Minute*10, dur)
+		require.Equal(t, 5, ff.called)
+	})
+
+	t.Run("RefreshErrorHandler", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx    = testutil.Context(t, testutil.WaitShort)
+			logger = slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			clock  = quartz.NewMock(t)
+		)
+
+		now := clock.Now().UTC()
+		expected := codersdk.CryptoKey{
+			Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+			Secret:   generateKey(t, 64),
+			Sequence: 12,
+			StartsAt: now,
+		}
+		ff := &fakeFetcher{
+			keys: []codersdk.CryptoKey{
+				expected,
+			},
+		}
+
+		var (
+			cache   cryptokeys.SigningKeycache
+			handled []error
+		)
+		cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume,
+			cryptokeys.WithCacheClock(clock),
+			cryptokeys.WithCacheRefreshErrorHandler(func(err error) {
+				handled = append(handled, err)
+				// The handler must be able to call back into the cache.
+				_, _, err = cache.SigningKey(ctx)
+				assert.NoError(t, err)
+			}),
+		)
+		require.NoError(t, err)
+		require.Equal(t, 1, ff.called)
+
+		ff.err = xerrors.New("fetch failed")
+		_, advance := clock.AdvanceNext()
+		advance.MustWait(ctx)
+		require.Equal(t, 2, ff.called)
+		require.Len(t, handled, 1)
+		require.ErrorIs(t, handled[0], ff.err)
+
+		// Successful refreshes should not call the handler.
+		ff.err = nil
+		_, advance = clock.AdvanceNext()
+		advance.MustWait(ctx)
+		require.Equal(t, 3, ff.called)
+		require.Len(t, handled, 1)
+	})
+
+	t.Run("LatestChanged", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx    = testutil.Context(t, testutil.WaitShort)
+			logger = slogtest.Make(t, nil)
+			clock  = quartz.NewMock(t)
+		)
+
+		now := clock.Now().UTC()
+		first := codersdk.CryptoKey{
+			Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+			Secret:   generateKey(t, 64),
+			Sequence: 12,
+			StartsAt: now,
+		}
+		ff := &fakeFetcher{
+			keys: []codersdk.CryptoKey{
+				first,
+			},
+		}
+
+		type change struct {
+			old, latest codersdk.CryptoKey
+		}
+		var (
+			cache   cryptokeys.SigningKeycache
+			changes []change
+		)
+		cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume,
+			cryptokeys.WithCacheClock(clock),
+			cryptokeys.WithCacheLatestChangedCallback(func(old, latest codersdk.CryptoKey) {
+				changes = append(changes, change{old: old, latest: latest})
+				// The callback must be able to call back into the cache.
+				id, _, err := cache.SigningKey(ctx)
+				assert.NoError(t, err)
+				assert.Equal(t, keyID(latest), id)
+			}),
+		)
+		require.NoError(t, err)
+		// The initial fetch is not a change.
+		require.Empty(t, changes)
+
+		// Fetching the same keys again is not a change.
+		err = cache.Refresh(ctx)
+		require.NoError(t, err)
+		require.Empty(t, changes)
+
+		rotated := codersdk.CryptoKey{
+			Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+			Secret:   generateKey(t, 64),
+			Sequence: 13,
+			StartsAt: now,
+		}
+		ff.keys = []codersdk.CryptoKey{first, rotated}
+
+		err = cache.Refresh(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []change{{old: first, latest: rotated}}, changes)
+
+		err = cache.Refresh(ctx)
+		require.NoError(t, err)
+		require.Len(t, changes, 1)
+	})
+
+	t.Run("LatestChangedSerialized", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx    = testutil.Context(t, testutil.WaitShort)
+			logger = slogtest.Make(t, nil)
+			clock  = quartz.NewMock(t)
+		)
+
+		now := clock.Now().UTC()
+		keys := make([]codersdk.CryptoKey, 3)
+		for i := range keys {
+			keys[i] = codersdk.CryptoKey{
+				Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+				Secret:   generateKey(t, 64),
+				Sequence: int32(12 + i),
+				StartsAt: now,
+			}
+		}
+		ff := &fakeFetcher{
+			keys: keys[:1],
+		}
+
+		type change struct {
+			old, latest codersdk.CryptoKey
+		}
+		var (
+			changes []change
+			entered = make(chan struct{})
+			release = make(chan struct{})
+		)
+		cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume,
+			cryptokeys.WithCacheClock(clock),
+			cryptokeys.WithCacheLatestChangedCallback(func(old, latest codersdk.CryptoKey) {
+				changes = append(changes, change{old: old, latest: latest})
+				if len(changes) == 1 {
+					close(entered)
+					<-release
+				}
+			}),
+		)
+		require.NoError(t, err)
+
+		ff.keys = keys[:2]
+		done := make(chan error, 1)
+		go func() {
+			done <- cache.Refresh(ctx)
+		}()
+		testutil.RequireRecvCtx(ctx, t, entered)
+
+		// A fetch that completes while a callback is running leaves its
+		// change to the caller that is already delivering.
+		ff.keys = keys
+		err = cache.Refresh(ctx)
+		require.NoError(t, err)
+
+		close(release)
+		err = testutil.RequireRecvCtx(ctx, t, done)
+		require.NoError(t, err)
+		require.Equal(t, []change{
+			{old: keys[0], latest: keys[1]},
+			{old: keys[1], latest: keys[2]},
+		}, changes)
+	})
+
+	t.Run("InitialFetchTimeout", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx    = testutil.Context(t, testutil.WaitShort)
+			logger = slogtest.Make(t, nil)
+			clock  = quartz.NewMock(t)
+		)
+
+		ff := &fakeFetcher{
+			block: make(chan struct{}),
+		}
+
+		_, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume,
+			cryptokeys.WithCacheClock(clock),
+			cryptokeys.WithCacheInitialFetchTimeout(testutil.IntervalFast),
+		)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.ErrorContains(t, err, "timed out")
+		require.NoError(t, ctx.Err())
+		require.Equal(t, 1, ff.called)
+	})
+
+	t.Run("RefreshTimeout", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx    = testutil.Context(t, testutil.WaitShort)
+			logger = slogtest.Make(t, &slogtest.Options{IgnoreErrors: true})
+			clock  = quartz.NewMock(t)
+		)
+
+		now := clock.Now().UTC()
+		expected := codersdk.CryptoKey{
+			Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+			Secret:   generateKey(t, 64),
+			Sequence: 12,
+			StartsAt: now,
+		}
+		ff := &fakeFetcher{
+			keys: []codersdk.CryptoKey{
+				expected,
+			},
+		}
+
+		var handled []error
+		cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume,
+			cryptokeys.WithCacheClock(clock),
+			cryptokeys.WithCacheRefreshTimeout(testutil.IntervalFast),
+			cryptokeys.WithCacheRefreshErrorHandler(func(err error) {
+				handled = append(handled, err)
+			}),
+		)
+		require.NoError(t, err)
+		require.Equal(t, 1, ff.called)
+
+		// A fetch that never returns should be abandoned once the timeout
+		// passes.
+		ff.block = make(chan struct{})
+		_, advance := clock.AdvanceNext()
+		advance.MustWait(ctx)
+		require.Equal(t, 2, ff.called)
+		require.Len(t, handled, 1)
+		require.ErrorIs(t, handled[0], context.DeadlineExceeded)
+		close(ff.block)
+		ff.block = nil
+
+		// The next tick should still fetch.
+		rotated := codersdk.CryptoKey{
+			Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+			Secret:   generateKey(t, 64),
+			Sequence: 13,
+			StartsAt: now,
+		}
+		ff.keys = []codersdk.CryptoKey{expected, rotated}
+		dur, advance := clock.AdvanceNext()
+		advance.MustWait(ctx)
+		require.Equal(t, time.Minute*10, dur)
+		require.Equal(t, 3, ff.called)
+		require.Len(t, handled, 1)
+
+		id, _, err := cache.SigningKey(ctx)
+		require.NoError(t, err)
+		require.Equal(t, keyID(rotated), id)
+	})
+
+	t.Run("WithoutBackgroundRefresh", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx    = testutil.Context(t, testutil.WaitShort)
+			logger = slogtest.Make(t, nil)
+			clock  = quartz.NewMock(t)
+		)
+
+		now := clock.Now().UTC()
+		expected := codersdk.CryptoKey{
+			Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+			Secret:   generateKey(t, 64),
+			Sequence: 12,
+			StartsAt: now,
+		}
+		ff := &fakeFetcher{
+			keys: []codersdk.CryptoKey{
+				expected,
+			},
+		}
+
+		cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume,
+			cryptokeys.WithCacheClock(clock),
+			cryptokeys.WithoutCacheBackgroundRefresh(),
+		)
+		require.NoError(t, err)
+		require.Equal(t, 1, ff.called)
+
+		// No refresh timer should be armed.
+		_, ok := clock.Peek()
+		require.False(t, ok)
+
+		id, got, err := cache.SigningKey(ctx)
+		require.NoError(t, err)
+		require.Equal(t, keyID(expected), id)
+		require.Equal(t, decodedSecret(t, expected), got)
+		require.Equal(t, 1, ff.called)
+
+		// Misses and explicit refreshes should still fetch.
+		rotated := codersdk.CryptoKey{
+			Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+			Secret:   generateKey(t, 64),
+			Sequence: 13,
+			StartsAt: now,
+		}
+		ff.keys = []codersdk.CryptoKey{expected, rotated}
+		key, err := cache.VerifyingKey(ctx, keyID(rotated))
+		require.NoError(t, err)
+		require.Equal(t, decodedSecret(t, rotated), key)
+		require.Equal(t, 2, ff.called)
+
+		err = cache.Refresh(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 3, ff.called)
+
+		_, ok = clock.Peek()
+		require.False(t, ok)
+
+		require.NoError(t, cache.Close())
+	})
+
+	t.Run("CanceledContext", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx    = testutil.Context(t, testutil.WaitShort)
+			logger = slogtest.Make(t, nil)
+			clock  = quartz.NewMock(t)
+			reg    = prometheus.NewRegistry()
+		)
+
+		ff := &fakeFetcher{
+			keys: []codersdk.CryptoKey{},
+		}
+
+		cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume,
+			cryptokeys.WithCacheClock(clock),
+			cryptokeys.WithCacheMetrics(reg),
+		)
+		require.NoError(t, err)
+		require.Equal(t, 1, ff.called)
+
+		canceledCtx, cancelCanceled := context.WithCancel(ctx)
+		cancelCanceled()
+
+		_, _, err = cache.SigningKey(canceledCtx)
+		require.ErrorIs(t, err, context.Canceled)
+
+		_, err = cache.VerifyingKey(canceledCtx, "12")
+		require.ErrorIs(t, err, context.Canceled)
+
+		// Neither lookup should have reached the fetcher.
+		require.Equal(t, 1, ff.called)
+
+		// Callers waiting on a slow fetch should return as soon as their
+		// context is canceled.
+		ff.block = make(chan struct{})
+		fetchErr := make(chan error, 1)
+		go func() {
+			_, err := cache.VerifyingKey(ctx, "12")
+			fetchErr <- err
+		}()
+		waitForMisses(ctx, t, reg, codersdk.CryptoKeyFeatureTailnetResume, 1)
+
+		waitCtx, cancel := context.WithCancel(ctx)
+		waitErr := make(chan error, 2)
+		go func() {
+			_, err := cache.VerifyingKey(waitCtx, "12")
+			waitErr <- err
+		}()
+		waitForMisses(ctx, t, reg, codersdk.CryptoKeyFeatureTailnetResume, 2)
+		go func() {
+			waitErr <- cache.Refresh(waitCtx)
+		}()
+
+		cancel()
+		for range 2 {
+			err = testutil.RequireRecvCtx(ctx, t, waitErr)
+			require.ErrorIs(t, err, context.Canceled)
+		}
+
+		close(ff.block)
+		err = testutil.RequireRecvCtx(ctx, t, fetchErr)
+		require.ErrorIs(t, err, cryptokeys.ErrKeyNotFound)
+	})
+
+	t.Run("NilFetcher", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx    = testutil.Context(t, testutil.WaitShort)
+			logger = slogtest.Make(t, nil)
+		)
+
+		_, err := cryptokeys.NewSigningCache(ctx, logger, nil, codersdk.CryptoKeyFeatureTailnetResume)
+		require.ErrorContains(t, err, "fetcher must not be nil")
+
+		_, err = cryptokeys.NewEncryptionCache(ctx, logger, nil, codersdk.CryptoKeyFeatureWorkspaceApp)
+		require.ErrorContains(t, err, "fetcher must not be nil")
+
+		_, err = cryptokeys.NewSigningCache(ctx, logger, &cryptokeys.DBFetcher{
+			Feature: database.CryptoKeyFeatureTailnetResume,
+		}, codersdk.CryptoKeyFeatureTailnetResume)
+		require.ErrorContains(t, err, "db must not be nil")
+
+		_, err = cryptokeys.NewSigningCache(ctx, logger, (*cryptokeys.DBFetcher)(nil), codersdk.CryptoKeyFeatureTailnetResume)
+		require.ErrorContains(t, err, "db must not be nil")
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx    = testutil.Context(t, testutil.WaitShort)
+			logger = slogtest.Make(t, nil)
+			clock  = quartz.NewMock(t)
+		)
+
+		now := clock.Now()
+		expected := codersdk.CryptoKey{
+			Feature:  codersdk.CryptoKeyFeatureTailnetResume,
+			Secret:   generateKey(t, 64),
+			Sequence: 12,
+			StartsAt: now,
+		}
+		ff := &fakeFetcher{
+			keys: []codersdk.CryptoKey{
+				expected,
+			},
+		}
+
+		cache, err := cryptokeys.NewSigningCache(ctx, logger, ff, codersdk.CryptoKeyFeatureTailnetResume, cryptokeys.WithCacheClock(clock))
+		require.NoError(t, err)
+
+		id, got, err := cache.SigningKey(ctx)
+		require.NoError(t, err)
+		require.Equal(t, keyID(expected), id)
+		require.Equal(t, decodedSecret(t, expected), got)
+		require.Equal(t, 1, ff.called)
+
+		key, err := cache.VerifyingKey(ctx, keyID(expected))
+		require.NoError(t, err)
+		require.Equal(t, decodedSecret(t, expected), key)
+		require.Equal(t, 1, ff.called)
+
+		cache.Close()
+
+		_, _, err = cache.SigningKey(ctx)
+		require.ErrorIs(t, err, cryptokeys.ErrClosed)
+
+		_, err = cache.VerifyingKey(ctx, keyID(expected))
+		require.ErrorIs(t, err, cryptokeys.ErrClosed)
+
+		err = cache.Refresh(ctx)
+		require.ErrorIs(t, err, cryptokeys.ErrClosed)
+	})
+}
+
+// waitForMisses waits until the cache has counted n misses. A lookup counts
+// its miss with the cache's lock held, before waiting on a fetch in flight, so
+// once it is counted the lookup is either fetching or waiting on that fetch.
+func waitForMisses(ctx context.Context, t *testing.T, reg *prometheus.Registry, feature codersdk.CryptoKeyFeature, n int) {
+	t.Helper()
+	testutil.Eventually(ctx, t, func(context.Context) bool {
+		metrics, err := reg.Gather()
+		if !assert.NoError(t, err) {
+			return false
+		}
+		return testutil.PromCounterHasValue(t, metrics, float64(n), "coderd_keychain_cache_misses_total", string(feature))
+	}, testutil.IntervalFast)
+}
+
+func requireSigningKeys(t *testing.T, reg *prometheus.Registry, feature codersdk.CryptoKeyFeature, n int) {
+	t.Helper()
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	require.True(t, testutil.PromGaugeHasValue(t, metrics, float64(n), "coderd_keychain_signing_keys", string(feature)))
+}
+
+type fakeFetcher struct {
+	keys   []codersdk.CryptoKey
+	err    error
 	called int
+	// block, if set, blocks fetches until it is closed or the context is
+	// canceled.
+	block chan struct{}
 }
 
-func (f *fakeFetcher) Fetch(_ context.Context) ([]codersdk.CryptoKey, error) {
+func (f *fakeFetcher) Fetch(ctx context.Context) ([]codersdk.CryptoKey, error) {
 	f.called++
+	if f.block != nil {
+		select {
+		case <-f.block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
 	return f.keys, nil
 }
 
+type fakeSink struct {
+	entries []slog.SinkEntry
+}
+
+func (s *fakeSink) LogEntry(_ context.Context, e slog.SinkEntry) {
+	s.entries = append(s.entries, e)
+}
+
+func (*fakeSink) Sync() {}
+
 func keyID(key codersdk.CryptoKey) string {
 	return strconv.FormatInt(int64(key.Sequence), 10)
 }
@@ -510,7 +1506,7 @@ func generateKey(t *testing.T, size int) string {
 	t.Helper()
 
 	key := make([]byte, size)
-	_, err := rand.Read(key)
+	_, err := cryptorand.Read(key)
 	require.NoError(t, err)
 
 	return hex.EncodeToString(key)
@@ -0,0 +1,110 @@
+package cryptokeys
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/v2/codersdk"
+)
+
+// cacheMetrics tracks cache activity. A nil *cacheMetrics is valid and
+// records nothing.
+type cacheMetrics struct {
+	hits          *prometheus.CounterVec
+	misses        *prometheus.CounterVec
+	refreshes     *prometheus.CounterVec
+	refreshErrors *prometheus.CounterVec
+	signingKeys   *prometheus.GaugeVec
+}
+
+func newCacheMetrics(reg prometheus.Registerer) (*cacheMetrics, error) {
+	newCounter := func(name, help string) (*prometheus.CounterVec, error) {
+		return register(reg, name, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "coderd",
+			Subsystem: "keychain",
+			Name:      name,
+			Help:      help,
+		}, []string{"feature"}))
+	}
+
+	var (
+		m   cacheMetrics
+		err error
+	)
+	m.hits, err = newCounter("cache_hits_total", "Total number of key lookups served from the cache.")
+	if err != nil {
+		return nil, err
+	}
+	m.misses, err = newCounter("cache_misses_total", "Total number of key lookups that required a fetch.")
+	if err != nil {
+		return nil, err
+	}
+	m.refreshes, err = newCounter("refresh_total", "Total number of cache refreshes.")
+	if err != nil {
+		return nil, err
+	}
+	m.refreshErrors, err = newCounter("refresh_errors_total", "Total number of cache refreshes that failed.")
+	if err != nil {
+		return nil, err
+	}
+	m.signingKeys, err = register(reg, "signing_keys", prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "coderd",
+		Subsystem: "keychain",
+		Name:      "signing_keys",
+		Help:      "Number of keys valid for signing that are not scheduled for deletion. More than one indicates overlapping signing windows.",
+	}, []string{"feature"}))
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// register registers the collector with the registerer. A cache is created per
+// feature, so multiple caches may share a registry, in which case the collector
+// that is already registered is returned.
+func register[T prometheus.Collector](reg prometheus.Registerer, name string, collector T) (T, error) {
+	err := reg.Register(collector)
+	var are prometheus.AlreadyRegisteredError
+	if xerrors.As(err, &are) {
+		existing, ok := are.ExistingCollector.(T)
+		if !ok {
+			return collector, xerrors.Errorf("metric %q registered with unexpected type %T", name, are.ExistingCollector)
+		}
+		return existing, nil
+	}
+	if err != nil {
+		return collector, xerrors.Errorf("register %q: %w", name, err)
+	}
+	return collector, nil
+}
+
+func (m *cacheMetrics) hit(feature codersdk.CryptoKeyFeature) {
+	if m == nil {
+		return
+	}
+	m.hits.WithLabelValues(string(feature)).Inc()
+}
+
+func (m *cacheMetrics) miss(feature codersdk.CryptoKeyFeature) {
+	if m == nil {
+		return
+	}
+	m.misses.WithLabelValues(string(feature)).Inc()
+}
+
+func (m *cacheMetrics) refresh(feature codersdk.CryptoKeyFeature, err error) {
+	if m == nil {
+		return
+	}
+	m.refreshes.WithLabelValues(string(feature)).Inc()
+	if err != nil {
+		m.refreshErrors.WithLabelValues(string(feature)).Inc()
+	}
+}
+
+func (m *cacheMetrics) setSigningKeys(feature codersdk.CryptoKeyFeature, n int) {
+	if m == nil {
+		return
+	}
+	m.signingKeys.WithLabelValues(string(feature)).Set(float64(n))
+}